@@ -0,0 +1,232 @@
+package twopc
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// CoordinatorResolver resolves the current address of the
+// coordinator, so a participant can follow a coordinator that moves
+// (failover, or one of several coordinator endpoints) instead of
+// being pinned to a fixed address for its whole lifetime.
+type CoordinatorResolver interface {
+	Resolve() (string, error)
+}
+
+// staticCoordinatorResolver always resolves to the same address; it
+// is what NewParticipant wires up by default.
+type staticCoordinatorResolver string
+
+func (s staticCoordinatorResolver) Resolve() (string, error) {
+	return string(s), nil
+}
+
+const (
+	coordinatorMinBackoff = 100 * time.Millisecond
+	coordinatorMaxBackoff = 10 * time.Second
+)
+
+// coordinatorClient owns the lifecycle of the connection to the
+// coordinator: dialing, reconnecting with exponential backoff and
+// jitter on failure, and unblocking anyone waiting on a dead
+// connection instead of handing out a stale pooled client.
+type coordinatorClient struct {
+	network  string
+	resolver CoordinatorResolver
+
+	// OnUnreachable, if set, is invoked once the coordinator has been
+	// continuously unreachable for at least UnreachableThreshold,
+	// with how long it has been unreachable.
+	OnUnreachable        func(time.Duration)
+	UnreachableThreshold time.Duration
+
+	mu                  sync.Mutex
+	closeOnce           sync.Once
+	client              *rpc.Client
+	closeCh             chan struct{} // closed when the held client dies
+	stopped             bool
+	firstFailure        time.Time
+	notifiedUnreachable bool
+}
+
+// newCoordinatorClient creates a client that lazily dials resolver's
+// address on first use.
+func newCoordinatorClient(network string, resolver CoordinatorResolver) *coordinatorClient {
+	return &coordinatorClient{network: network, resolver: resolver, closeCh: make(chan struct{})}
+}
+
+// WaitForClose returns a channel that is closed when the
+// currently-held connection dies, so a caller blocked on a pending
+// call can stop waiting on it instead of hanging on a stale client.
+func (c *coordinatorClient) WaitForClose() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closeCh
+}
+
+// Call issues serviceMethod against the coordinator, (re)dialing with
+// backoff if there is no live connection, and honoring ctx's
+// deadline.
+func (c *coordinatorClient) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	client, err := c.ensureConnected(ctx)
+	if err != nil {
+		return err
+	}
+
+	call := client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error != nil {
+			c.invalidate(client)
+			return call.Error
+		}
+		return nil
+	case <-c.WaitForClose():
+		return rpc.ErrShutdown
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *coordinatorClient) ensureConnected(ctx context.Context) (*rpc.Client, error) {
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return nil, rpc.ErrShutdown
+	}
+	if c.client != nil {
+		client := c.client
+		c.mu.Unlock()
+		return client, nil
+	}
+	c.mu.Unlock()
+
+	backoff := coordinatorMinBackoff
+	for {
+		c.mu.Lock()
+		if c.stopped {
+			c.mu.Unlock()
+			return nil, rpc.ErrShutdown
+		}
+		resolver := c.resolver
+		c.mu.Unlock()
+
+		addr, err := resolver.Resolve()
+		if err == nil {
+			var conn net.Conn
+			conn, err = (&net.Dialer{}).DialContext(ctx, c.network, addr)
+			if err == nil {
+				client := rpc.NewClient(conn)
+				c.mu.Lock()
+				if c.stopped {
+					c.mu.Unlock()
+					client.Close()
+					return nil, rpc.ErrShutdown
+				}
+				c.client = client
+				c.firstFailure = time.Time{}
+				c.notifiedUnreachable = false
+				c.mu.Unlock()
+				return client, nil
+			}
+		}
+		c.recordFailure()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(jitter(backoff)):
+		}
+		backoff *= 2
+		if backoff > coordinatorMaxBackoff {
+			backoff = coordinatorMaxBackoff
+		}
+	}
+}
+
+// invalidate drops client if it is still the one currently held and
+// wakes up anyone in WaitForClose(). It is a no-op once Close has
+// been called: Close already closed closeCh once, and replacing it
+// here would leave a channel behind that nothing ever closes.
+func (c *coordinatorClient) invalidate(client *rpc.Client) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client != client {
+		return
+	}
+	client.Close()
+	c.client = nil
+	if c.stopped {
+		return
+	}
+	close(c.closeCh)
+	c.closeCh = make(chan struct{})
+}
+
+func (c *coordinatorClient) recordFailure() {
+	c.mu.Lock()
+	if c.firstFailure.IsZero() {
+		c.firstFailure = time.Now()
+	}
+	unreachableFor := time.Since(c.firstFailure)
+	shouldNotify := !c.notifiedUnreachable && c.UnreachableThreshold > 0 &&
+		unreachableFor >= c.UnreachableThreshold && c.OnUnreachable != nil
+	if shouldNotify {
+		c.notifiedUnreachable = true
+	}
+	cb := c.OnUnreachable
+	c.mu.Unlock()
+
+	if shouldNotify {
+		cb(unreachableFor)
+	}
+}
+
+// Close shuts down the client's current connection and marks it
+// stopped for good: every later Call (pending or new) fails fast with
+// rpc.ErrShutdown instead of reconnecting. Safe to call more than
+// once.
+func (c *coordinatorClient) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.stopped = true
+		if c.client != nil {
+			err = c.client.Close()
+			c.client = nil
+		}
+		close(c.closeCh)
+	})
+	return err
+}
+
+// SetResolver replaces how the client resolves the coordinator's
+// address.
+func (c *coordinatorClient) SetResolver(resolver CoordinatorResolver) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resolver = resolver
+}
+
+// SetUnreachableCallback registers callback to be invoked once the
+// coordinator has been continuously unreachable for at least
+// threshold.
+func (c *coordinatorClient) SetUnreachableCallback(threshold time.Duration, callback func(time.Duration)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.UnreachableThreshold = threshold
+	c.OnUnreachable = callback
+}
+
+// jitter returns a duration in [d/2, d], so concurrent
+// participants reconnecting after the same outage don't all retry in
+// lockstep.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
@@ -0,0 +1,27 @@
+package twopc
+
+// Decision is the final, durable outcome of a transaction part as
+// known by the coordinator, returned to a participant that is
+// resolving an in-doubt part after a crash.
+type Decision int
+
+const (
+	DecisionUnknown Decision = iota
+	DecisionCommit
+	DecisionAbort
+)
+
+// GetTxnDecisionArgs is the argument of Coordinator.GetTxnDecision,
+// used by a participant recovering an in-doubt (PREPARED) part to
+// ask the coordinator what it decided.
+type GetTxnDecisionArgs struct {
+	TxnID     string
+	TxnPartID string
+}
+
+// GetTxnDecisionReply carries the coordinator's decision, or
+// DecisionUnknown if the coordinator has not decided yet and the
+// participant should keep retrying.
+type GetTxnDecisionReply struct {
+	Decision Decision
+}
@@ -15,36 +15,62 @@ package twopc
 // if receving all StateCommitted.
 
 import (
-	"distributed-system/util"
+	"context"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"net/rpc"
+	"reflect"
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 )
 
+// DefaultCoordinatorCallTimeout bounds how long a single coordinator
+// RPC (InformPrepared, InformAborted, GetTxnDecision, ...) is allowed
+// to take before it is treated as failed and retried.
+const DefaultCoordinatorCallTimeout = 5 * time.Second
+
+// DefaultKillTimeout bounds how long Kill waits for in-flight work to
+// drain before giving up; Kill must never block a test suite
+// indefinitely, even if the coordinator is unreachable.
+const DefaultKillTimeout = 5 * time.Second
+
 // Participant is the executed role of two-phase commit.
 type Participant struct {
-	mu   sync.Mutex
-	l    net.Listener
-	rpcs *rpc.Server
-	pool *util.ResourcePool
+	mu    sync.Mutex
+	l     net.Listener
+	rpcs  *rpc.Server
+	coord *coordinatorClient
 
 	dead       int32 // for testing
 	unreliable int32 // for testing
 	rpcCount   int32 // for testing
 
-	network   string // "unix" or "tcp"
-	coord     string // coordinator address
-	addr      string // ppt service address
-	txnsMu    sync.Mutex
-	txnsParts map[string]*TxnPart
+	network              string // "unix" or "tcp"
+	coordAddr            string // coordinator address
+	addr                 string // ppt service address
+	callTimeout          time.Duration
+	prepareTimeout       time.Duration
+	presumedAbortTimeout time.Duration
+	onPresumedAbort      func(tp *TxnPart)
+	txnsMu               sync.Mutex
+	txnsParts            map[string]*TxnPart
 	// sbPrepared bool // some particpant has prepared
 
+	presumedMu      sync.Mutex
+	presumedAborted map[string]bool
+
 	callerMap map[string]Caller
+
+	store TxnPartStore // write-ahead log, nil disables crash recovery
+
+	wg              sync.WaitGroup // in-flight executeTxnPart (and follow-up) goroutines
+	shuttingDown    int32          // set once Shutdown/Kill has been called
+	shutdownDone    chan struct{}  // closed once shutdown has finished
+	shutdownInDoubt int            // txn parts still in-doubt when shutdown finished
 }
 
 // RegisterCaller register a caller with a unique name,
@@ -63,19 +89,34 @@ func (ppt *Participant) executeTxnPart(tp *TxnPart) {
 }
 
 // SubmitTxnPart submit the TxnPart to the participant and start it.
-// @reply could be nil.
+// @reply could be nil. tp.ReadOnly must already be set by the caller
+// if this part's Caller never mutates anything; see readonly.go.
 func (ppt *Participant) SubmitTxnPart(tp *TxnPart, reply *struct{}) error {
 	// fmt.Println("SubmitTxnPart", *tp)
+	if atomic.LoadInt32(&ppt.shuttingDown) != 0 {
+		return ErrShuttingDown
+	}
 	tp.state = StateTxnPartWorking
+	if !tp.ReadOnly {
+		ppt.logRecord(TxnPartRecord{Kind: RecordSubmitted, ID: tp.ID, TxnID: tp.TxnID,
+			CallName: tp.CallName, InitRet: tp.InitRet})
+	}
 	ppt.txnsMu.Lock()
 	ppt.txnsParts[tp.ID] = tp
 	ppt.txnsMu.Unlock()
+	ppt.wg.Add(1)
 	go func() {
+		defer ppt.wg.Done()
 		ppt.executeTxnPart(tp)
-		if tp.errCode != 0 {
+		switch {
+		case tp.errCode != 0:
 			// Call failed.
 			ppt.aborted(tp)
-		} else {
+		case tp.ReadOnly:
+			// Call succeeded and never mutated anything: skip the
+			// prepare/commit round trips entirely.
+			ppt.readOnlyDone(tp)
+		default:
 			// Call successfully.
 			ppt.prepared(tp)
 		}
@@ -83,6 +124,23 @@ func (ppt *Participant) SubmitTxnPart(tp *TxnPart, reply *struct{}) error {
 	return nil
 }
 
+// readOnlyDone is the read-only fast path counterpart of prepared: a
+// read-only part commits locally without a persistent prepare record
+// and tells the coordinator once, instead of waiting for a later
+// Commit/Abort. There is no further round trip after that, so it is
+// ended here like Commit/Abort do for every other terminal part; if a
+// sibling writer then aborts, the coordinator's Abort RPC for this
+// part's ID simply finds nothing left to roll back (see Abort, which
+// already tolerates that), which is what "still participates in abort
+// notification" amounts to for a part with no side effects.
+func (ppt *Participant) readOnlyDone(tp *TxnPart) {
+	atomic.StoreInt32(&tp.state, StateTxnPartCommitted)
+	args := ReadOnlyDoneArgs{TxnPartIdx: tp.Idx, TxnID: tp.TxnID, ErrCode: tp.errCode}
+	var reply ReadOnlyDoneReply
+	ppt.callCoordinator("Coordinator.InformReadOnlyDone", args, &reply)
+	ppt.endTxnPart(tp.ID)
+}
+
 // Prepared is the action when the participant declares
 // the prepared state for the part of the transaction.
 //
@@ -90,15 +148,17 @@ func (ppt *Participant) SubmitTxnPart(tp *TxnPart, reply *struct{}) error {
 // think the part of the transcation is ok.
 func (ppt *Participant) prepared(tp *TxnPart) {
 	atomic.StoreInt32(&tp.state, StateTxnPartPrepared)
+	ppt.logRecord(TxnPartRecord{Kind: RecordPrepared, ID: tp.ID, TxnID: tp.TxnID,
+		CallName: tp.CallName, InitRet: tp.InitRet})
 	// assert ppt.me == tp.Shard
 	args := PreparedArgs{TxnPartIdx: tp.Idx, TxnID: tp.TxnID, ErrCode: tp.errCode}
 	var reply PreparedReply
-	var ok = false
-	for !ok {
-		c := ppt.pool.Get().(*rpc.Client)
-		ok = util.RPCPoolCall(ppt.pool, "Coordinator.InformPrepared", args, &reply)
-		ppt.pool.Put(c)
-	}
+	ppt.callCoordinator("Coordinator.InformPrepared", args, &reply)
+	ppt.wg.Add(1)
+	go func() {
+		defer ppt.wg.Done()
+		ppt.watchPrepared(tp)
+	}()
 }
 
 // Aborted is the action when the participant aborts
@@ -112,14 +172,42 @@ func (ppt *Participant) aborted(tp *TxnPart) {
 	ppt.abort(tp)
 	args := AbortedArgs{TxnPartIdx: tp.Idx, TxnID: tp.TxnID, ErrCode: tp.errCode}
 	var reply AbortedReply
-	var ok = false
-	for !ok {
-		ok = util.RPCPoolCall(ppt.pool, "Coordinator.InformAborted", args, &reply)
+	ppt.callCoordinator("Coordinator.InformAborted", args, &reply)
+}
+
+// callCoordinator issues serviceMethod against the coordinator
+// through ppt.coord, retrying with the coordinatorClient's backoff
+// until it succeeds or the participant starts shutting down. Each
+// attempt gets its own deadline of ppt.callTimeout and its own reply
+// value: a prior attempt abandoned because its deadline expired can
+// still complete later (net/rpc has no call cancellation), and it
+// must not be able to write into the same reply a later, successful
+// attempt is using.
+//
+// Giving up once shuttingDown is set, rather than retrying forever,
+// is what lets Shutdown/Kill's wg.Wait() actually return: without it
+// a goroutine stuck here while the coordinator is unreachable would
+// block shutdown indefinitely.
+func (ppt *Participant) callCoordinator(serviceMethod string, args, reply interface{}) bool {
+	replyType := reflect.TypeOf(reply).Elem()
+	for atomic.LoadInt32(&ppt.shuttingDown) == 0 {
+		attempt := reflect.New(replyType)
+		ctx, cancel := context.WithTimeout(context.Background(), ppt.callTimeout)
+		err := ppt.coord.Call(ctx, serviceMethod, args, attempt.Interface())
+		cancel()
+		if err == nil {
+			reflect.ValueOf(reply).Elem().Set(attempt.Elem())
+			return true
+		}
 	}
+	return false
 }
 
 // Abort is invoked by coordinator.
 func (ppt *Participant) Abort(args *AbortArgs, reply *AbortReply) error {
+	if ppt.wasPresumedAborted(args.TxnPartID) {
+		return nil // agrees with what we already did; not a violation
+	}
 	tp := ppt.endTxnPart(args.TxnPartID)
 	// Abort method could be called not only once.
 	if tp != nil {
@@ -130,10 +218,18 @@ func (ppt *Participant) Abort(args *AbortArgs, reply *AbortReply) error {
 
 // Commit is invoked by coordinator.
 func (ppt *Participant) Commit(args *CommitArgs, reply *CommitReply) error {
+	if ppt.wasPresumedAborted(args.TxnPartID) {
+		// The participant already rolled this part back on its own
+		// under the presumed-abort rule; a Commit now means the
+		// coordinator's decision disagrees with ours.
+		return ErrLateDecision
+	}
 	tp := ppt.endTxnPart(args.TxnPartID)
 	// Commit method could be called not only once.
 	if tp != nil {
 		atomic.StoreInt32(&tp.state, StateTxnPartCommitted)
+		ppt.logRecord(TxnPartRecord{Kind: RecordCommitted, ID: tp.ID, TxnID: tp.TxnID})
+		ppt.compactStore()
 	}
 	return nil
 }
@@ -150,22 +246,42 @@ func (ppt *Participant) abort(tp *TxnPart) {
 	atomic.StoreInt32(&tp.state, StateTxnPartAborted)
 	if tp.canAbort == false {
 		tp.canAbort = true
-		if tp.rollbacker == nil {
+		if tp.rollbacker != nil {
+			tp.rollbacker.Rollback()
+		} else if !tp.ReadOnly {
 			panic("No rollbacker for " + tp.CallName)
 		}
-		tp.rollbacker.Rollback()
 	}
+	ppt.logRecord(TxnPartRecord{Kind: RecordAborted, ID: tp.ID, TxnID: tp.TxnID})
+	ppt.compactStore()
 }
 
-const DefaultPptPoolSize = 5
-
 // NewParticipant init a participant service.
-func NewParticipant(network, addr, coord string) *Participant {
-	ppt := &Participant{network: network, addr: addr, coord: coord,
-		txnsParts: make(map[string]*TxnPart), callerMap: make(map[string]Caller)}
-	ppt.pool = util.NewResourcePool(func() util.Resource {
-		return util.DialServer(network, coord)
-	}, DefaultPptPoolSize)
+//
+// logPath, if non-empty, is the write-ahead log used to recover
+// in-doubt transaction parts after a crash; see TxnPartStore. If
+// empty, the participant runs without crash recovery, as before.
+func NewParticipant(network, addr, coord, logPath string) *Participant {
+	ppt := &Participant{
+		network: network, addr: addr, coordAddr: coord,
+		callTimeout:          DefaultCoordinatorCallTimeout,
+		prepareTimeout:       DefaultPrepareTimeout,
+		presumedAbortTimeout: DefaultPresumedAbortTimeout,
+		txnsParts:            make(map[string]*TxnPart),
+		callerMap:            make(map[string]Caller),
+		presumedAborted:      make(map[string]bool),
+		shutdownDone:         make(chan struct{}),
+	}
+	ppt.coord = newCoordinatorClient(network, staticCoordinatorResolver(coord))
+
+	if logPath != "" {
+		store, err := NewFileTxnPartStore(logPath)
+		if err != nil {
+			log.Fatal("txn part store: ", err)
+		}
+		ppt.store = store
+		ppt.recover()
+	}
 
 	l, e := net.Listen(network, addr)
 	if e != nil {
@@ -217,14 +333,34 @@ func (ppt *Participant) RegisterRPCService(service interface{}) {
 	ppt.rpcs.Register(service)
 }
 
+// SetCoordinatorResolver replaces how the participant resolves the
+// coordinator's address, e.g. to support coordinator failover or a
+// set of coordinator endpoints instead of one fixed address.
+func (ppt *Participant) SetCoordinatorResolver(resolver CoordinatorResolver) {
+	ppt.coord.SetResolver(resolver)
+}
+
+// SetCoordinatorCallTimeout overrides the per-request deadline used
+// for coordinator RPCs. The default is DefaultCoordinatorCallTimeout.
+func (ppt *Participant) SetCoordinatorCallTimeout(d time.Duration) {
+	ppt.callTimeout = d
+}
+
+// OnCoordinatorUnreachable registers a callback invoked once the
+// coordinator has been continuously unreachable for at least
+// threshold, so business code can log or alert. It is called from a
+// background goroutine and must not block.
+func (ppt *Participant) OnCoordinatorUnreachable(threshold time.Duration, callback func(time.Duration)) {
+	ppt.coord.SetUnreachableCallback(threshold, callback)
+}
+
 // Kill tell the peer to shut itself down.
 // for testing.
 // please do not change these two functions.
 func (ppt *Participant) Kill() {
-	atomic.StoreInt32(&ppt.dead, 1)
-	if ppt.l != nil {
-		ppt.l.Close()
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultKillTimeout)
+	defer cancel()
+	ppt.Shutdown(ctx)
 }
 
 // Has this peer been asked to shut down?
@@ -0,0 +1,23 @@
+package twopc
+
+// A TxnPart with ReadOnly set takes the read-only fast path: it skips
+// the persistent prepare record and the second-phase Commit/Abort RPC
+// entirely, committing after a single round trip with the
+// coordinator. The submitter must set TxnPart.ReadOnly explicitly
+// before calling SubmitTxnPart; a Caller's Call signature is the same
+// whether or not its part is read-only, so there is no way to detect
+// this from the Caller itself (a read-only Caller still returns a
+// Rollbacker; executeTxnPart keeps it, and abort calls it if it is
+// non-nil, e.g. when the read-only part's Call failed).
+//
+// ReadOnlyDoneArgs is the argument of Coordinator.InformReadOnlyDone,
+// sent once by a read-only TxnPart instead of InformPrepared followed
+// by a Commit/Abort wait.
+type ReadOnlyDoneArgs struct {
+	TxnPartIdx int
+	TxnID      string
+	ErrCode    int
+}
+
+// ReadOnlyDoneReply is the reply of Coordinator.InformReadOnlyDone.
+type ReadOnlyDoneReply struct{}
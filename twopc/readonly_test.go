@@ -0,0 +1,164 @@
+package twopc
+
+import (
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCoordinator is a minimal stand-in for the real Coordinator RPC
+// service, just enough to drive the mixed read-only/write scenario
+// below without depending on the coordinator package.
+type fakeCoordinator struct {
+	mu           sync.Mutex
+	prepared     map[string]bool
+	readOnlyDone map[string]bool
+}
+
+func newFakeCoordinator() *fakeCoordinator {
+	return &fakeCoordinator{prepared: make(map[string]bool), readOnlyDone: make(map[string]bool)}
+}
+
+func (fc *fakeCoordinator) InformPrepared(args *PreparedArgs, reply *PreparedReply) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.prepared[args.TxnID] = true
+	return nil
+}
+
+func (fc *fakeCoordinator) InformAborted(args *AbortedArgs, reply *AbortedReply) error {
+	return nil
+}
+
+func (fc *fakeCoordinator) InformReadOnlyDone(args *ReadOnlyDoneArgs, reply *ReadOnlyDoneReply) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.readOnlyDone[args.TxnID] = true
+	return nil
+}
+
+func (fc *fakeCoordinator) GetTxnDecision(args *GetTxnDecisionArgs, reply *GetTxnDecisionReply) error {
+	reply.Decision = DecisionAbort
+	return nil
+}
+
+func (fc *fakeCoordinator) QueryDecision(args *QueryDecisionArgs, reply *QueryDecisionReply) error {
+	reply.Decision = DecisionAbort
+	return nil
+}
+
+func (fc *fakeCoordinator) waitFor(pred func() bool) bool {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		fc.mu.Lock()
+		ok := pred()
+		fc.mu.Unlock()
+		if ok {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
+
+// readCaller is a Caller for a read-only part: it never mutates
+// anything and returns no Rollbacker. Its TxnPart must have ReadOnly
+// set explicitly by the submitter (see readonly.go).
+type readCaller struct{}
+
+func (readCaller) Call(initRet interface{}) (int, Rollbacker) { return 0, nil }
+
+// writeCaller is a regular Caller whose Call records whether it was
+// rolled back.
+type writeCaller struct {
+	rolledBack *bool
+}
+
+func (c writeCaller) Call(initRet interface{}) (int, Rollbacker) {
+	return 0, &recordingRollbacker{rolledBack: c.rolledBack}
+}
+
+type recordingRollbacker struct {
+	rolledBack *bool
+}
+
+func (r *recordingRollbacker) Rollback() { *r.rolledBack = true }
+
+// TestMixedReadOnlyAndWriteAbort submits a read-only part and a write
+// part under the same transaction, aborts the write part, and checks
+// that the read-only part can still be told to abort without error
+// even though it already took the fast path and has nothing left to
+// roll back.
+func TestMixedReadOnlyAndWriteAbort(t *testing.T) {
+	coordListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen coordinator: %v", err)
+	}
+	defer coordListener.Close()
+
+	fc := newFakeCoordinator()
+	coordRPCs := rpc.NewServer()
+	if err := coordRPCs.RegisterName("Coordinator", fc); err != nil {
+		t.Fatalf("register fake coordinator: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := coordListener.Accept()
+			if err != nil {
+				return
+			}
+			go coordRPCs.ServeConn(conn)
+		}
+	}()
+
+	pptListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("reserve participant addr: %v", err)
+	}
+	pptAddr := pptListener.Addr().String()
+	pptListener.Close()
+
+	ppt := NewParticipant("tcp", pptAddr, coordListener.Addr().String(), "")
+	defer ppt.Kill()
+
+	var writeRolledBack bool
+	ppt.RegisterCaller(readCaller{}, "read")
+	ppt.RegisterCaller(writeCaller{rolledBack: &writeRolledBack}, "write")
+
+	const txnID = "txn-mixed-1"
+	readTp := &TxnPart{ID: txnID + "-read", TxnID: txnID, CallName: "read", ReadOnly: true}
+	writeTp := &TxnPart{ID: txnID + "-write", TxnID: txnID, CallName: "write"}
+
+	if err := ppt.SubmitTxnPart(readTp, &struct{}{}); err != nil {
+		t.Fatalf("submit read part: %v", err)
+	}
+	if err := ppt.SubmitTxnPart(writeTp, &struct{}{}); err != nil {
+		t.Fatalf("submit write part: %v", err)
+	}
+
+	if !fc.waitFor(func() bool { return fc.readOnlyDone[txnID] }) {
+		t.Fatal("coordinator never heard InformReadOnlyDone for the read-only part")
+	}
+	if !fc.waitFor(func() bool { return fc.prepared[txnID] }) {
+		t.Fatal("coordinator never heard InformPrepared for the write part")
+	}
+
+	// Coordinator decides to abort because the write part is the one
+	// that matters here; it notifies both parts, including the
+	// already-committed read-only one.
+	if err := ppt.Abort(&AbortArgs{TxnPartID: writeTp.ID}, &AbortReply{}); err != nil {
+		t.Fatalf("abort write part: %v", err)
+	}
+	if !writeRolledBack {
+		t.Fatal("write part was not rolled back on abort")
+	}
+
+	// The read-only part still "participates" in abort notification:
+	// telling it to abort must not error or panic, even though it
+	// already took the terminal fast path with nothing to roll back.
+	if err := ppt.Abort(&AbortArgs{TxnPartID: readTp.ID}, &AbortReply{}); err != nil {
+		t.Fatalf("abort read-only part: %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+package twopc
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RollbackerFactory rebuilds a Rollbacker purely from the InitRet a
+// Caller originally returned, so that a TxnPart left in-doubt by a
+// crash can still be rolled back without re-running the Caller.
+type RollbackerFactory func(initRet interface{}) Rollbacker
+
+var (
+	rollbackerFactoriesMu sync.Mutex
+	rollbackerFactories   = make(map[string]RollbackerFactory)
+)
+
+// RegisterRollbackerFactory registers factory under callName. It
+// must be called (for every CallName that can produce a Rollbacker)
+// before NewParticipant, so that recovery can rebuild rollbackers for
+// parts that were still WORKING or PREPARED when the process died.
+func RegisterRollbackerFactory(callName string, factory RollbackerFactory) {
+	rollbackerFactoriesMu.Lock()
+	defer rollbackerFactoriesMu.Unlock()
+	rollbackerFactories[callName] = factory
+}
+
+func rollbackerFor(callName string, initRet interface{}) Rollbacker {
+	rollbackerFactoriesMu.Lock()
+	factory, ok := rollbackerFactories[callName]
+	rollbackerFactoriesMu.Unlock()
+	if !ok {
+		return nil
+	}
+	return factory(initRet)
+}
+
+// recover replays the write-ahead log and resolves whatever it finds
+// in-doubt: a part still PREPARED is handed to a resolver goroutine
+// that asks the coordinator for the final decision; a part still
+// WORKING never told the coordinator anything, so it is presumed
+// aborted and rolled back locally if possible.
+func (ppt *Participant) recover() {
+	if ppt.store == nil {
+		return
+	}
+	records, err := ppt.store.Replay()
+	if err != nil {
+		log.Printf("Participant(%v) recover: replay log: %v", ppt.addr, err)
+		return
+	}
+
+	last := make(map[string]TxnPartRecord)
+	for _, r := range records {
+		last[r.ID] = r
+	}
+
+	for id, r := range last {
+		switch r.Kind {
+		case RecordPrepared:
+			tp := &TxnPart{ID: id, TxnID: r.TxnID, CallName: r.CallName, InitRet: r.InitRet}
+			atomic.StoreInt32(&tp.state, StateTxnPartPrepared)
+			tp.rollbacker = rollbackerFor(r.CallName, r.InitRet)
+			ppt.txnsMu.Lock()
+			ppt.txnsParts[id] = tp
+			ppt.txnsMu.Unlock()
+			ppt.wg.Add(1)
+			go func() {
+				defer ppt.wg.Done()
+				ppt.resolveInDoubt(tp)
+			}()
+		case RecordSubmitted:
+			// Still WORKING when we crashed: the coordinator was never
+			// told anything, so presume abort. Only roll back if we can
+			// rebuild a Rollbacker; otherwise there is nothing undone to
+			// undo and we just record the decision.
+			tp := &TxnPart{ID: id, TxnID: r.TxnID, CallName: r.CallName, InitRet: r.InitRet}
+			if rb := rollbackerFor(r.CallName, r.InitRet); rb != nil {
+				tp.rollbacker = rb
+				ppt.abort(tp)
+			} else {
+				atomic.StoreInt32(&tp.state, StateTxnPartAborted)
+				ppt.logRecord(TxnPartRecord{Kind: RecordAborted, ID: id, TxnID: r.TxnID})
+				ppt.compactStore()
+			}
+		case RecordPresumedAborted:
+			// This participant already unilaterally aborted this part
+			// before the crash. Remember that (the in-memory
+			// presumedAborted map does not survive a restart on its
+			// own) so a late Commit/Abort for it is still caught as a
+			// protocol violation instead of silently no-oping because
+			// the part is no longer in txnsParts.
+			ppt.markPresumedAborted(id)
+		}
+		// RecordAborted and RecordCommitted are already terminal on
+		// this side; nothing to resolve.
+	}
+}
+
+// resolveInDoubt asks the coordinator for the final decision of a
+// part that crashed after sending Prepared but before hearing back,
+// polling the same way resolvePrepared does for a live part: if the
+// coordinator replies DecisionUnknown (or is unreachable), it keeps
+// retrying, no faster than queryDecisionPollInterval, until
+// PresumedAbortTimeout elapses, at which point it presumes abort
+// unilaterally rather than waiting forever.
+func (ppt *Participant) resolveInDoubt(tp *TxnPart) {
+	deadline := time.Now().Add(ppt.presumedAbortTimeout)
+	args := GetTxnDecisionArgs{TxnID: tp.TxnID, TxnPartID: tp.ID}
+	for time.Now().Before(deadline) {
+		if atomic.LoadInt32(&tp.state) != StateTxnPartPrepared {
+			return // resolved while we were polling
+		}
+
+		if atomic.LoadInt32(&ppt.shuttingDown) != 0 {
+			return // shutting down
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), ppt.callTimeout)
+		var reply GetTxnDecisionReply
+		err := ppt.coord.Call(ctx, "Coordinator.GetTxnDecision", args, &reply)
+		cancel()
+		if err != nil {
+			continue // unreachable: retry until the deadline
+		}
+
+		switch reply.Decision {
+		case DecisionCommit:
+			ppt.Commit(&CommitArgs{TxnPartID: tp.ID}, &CommitReply{})
+			return
+		case DecisionAbort:
+			ppt.Abort(&AbortArgs{TxnPartID: tp.ID}, &AbortReply{})
+			return
+		}
+		// DecisionUnknown: the coordinator hasn't decided yet, keep
+		// polling, but not back-to-back.
+		time.Sleep(queryDecisionPollInterval)
+	}
+	ppt.presumeAbort(tp)
+}
+
+// logRecord appends record to the participant's write-ahead log, if
+// one is configured. A failure here is logged but not fatal: the
+// in-memory state is still correct, recovery just won't see it after
+// a crash.
+func (ppt *Participant) logRecord(r TxnPartRecord) {
+	if ppt.store == nil {
+		return
+	}
+	if err := ppt.store.Append(r); err != nil {
+		log.Printf("Participant(%v) txn part store append: %v", ppt.addr, err)
+	}
+}
+
+// compactStore drops log entries for every transaction part that is
+// no longer tracked in memory and was not presumed-aborted, i.e. has
+// reached an ordinary terminal state on both sides of the protocol.
+// A presumed-aborted part's RecordPresumedAborted entry is kept for
+// as long as presumedAborted remembers it, even though the part
+// itself left txnsParts long ago: that entry is what lets recover()
+// repopulate presumedAborted after a crash (see resolveInDoubt and
+// presumeAbort).
+func (ppt *Participant) compactStore() {
+	if ppt.store == nil {
+		return
+	}
+	ppt.txnsMu.Lock()
+	live := make(map[string]bool, len(ppt.txnsParts))
+	for id := range ppt.txnsParts {
+		live[id] = true
+	}
+	ppt.txnsMu.Unlock()
+
+	ppt.presumedMu.Lock()
+	for id := range ppt.presumedAborted {
+		live[id] = true
+	}
+	ppt.presumedMu.Unlock()
+
+	if err := ppt.store.Compact(live); err != nil {
+		log.Printf("Participant(%v) compact txn part store: %v", ppt.addr, err)
+	}
+}
@@ -0,0 +1,74 @@
+package twopc
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrShuttingDown is returned by SubmitTxnPart once the participant
+// has started shutting down.
+var ErrShuttingDown = errors.New("twopc: participant is shutting down")
+
+// Shutdown gracefully stops the participant: it stops accepting new
+// transaction parts, waits for in-flight executeTxnPart work (and its
+// prepared/aborted/watchPrepared follow-ups) to finish or for ctx to
+// expire, and closes the coordinator connection and write-ahead log.
+// It is safe to call concurrently and more than once: only the first
+// call shuts down, and a later call waits for it to finish (or for its
+// own ctx to expire) and then returns the same in-doubt count with a
+// nil error. It returns the number of transaction parts still in-doubt
+// (PREPARED, with no decision yet) when it returns, so operators know
+// whether recovery will be needed on the next start.
+func (ppt *Participant) Shutdown(ctx context.Context) (int, error) {
+	if !atomic.CompareAndSwapInt32(&ppt.shuttingDown, 0, 1) {
+		select {
+		case <-ppt.shutdownDone:
+			return ppt.shutdownInDoubt, nil
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+
+	atomic.StoreInt32(&ppt.dead, 1)
+	if ppt.l != nil {
+		ppt.l.Close()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		ppt.wg.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	ppt.shutdownInDoubt = ppt.countInDoubt()
+
+	if ppt.store != nil {
+		ppt.store.Close()
+	}
+	ppt.coord.Close() // coordinatorClient.Close is itself a sync.Once
+
+	close(ppt.shutdownDone)
+	return ppt.shutdownInDoubt, err
+}
+
+// countInDoubt returns how many tracked transaction parts are still
+// PREPARED, i.e. would need crash recovery to resolve on restart.
+func (ppt *Participant) countInDoubt() int {
+	ppt.txnsMu.Lock()
+	defer ppt.txnsMu.Unlock()
+	n := 0
+	for _, tp := range ppt.txnsParts {
+		if atomic.LoadInt32(&tp.state) == StateTxnPartPrepared {
+			n++
+		}
+	}
+	return n
+}
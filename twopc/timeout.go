@@ -0,0 +1,167 @@
+package twopc
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultPrepareTimeout bounds how long a participant waits in
+// StateTxnPartPrepared for the coordinator's Commit/Abort before it
+// starts actively querying for a decision.
+const DefaultPrepareTimeout = 10 * time.Second
+
+// DefaultPresumedAbortTimeout bounds how much longer, once
+// PrepareTimeout has fired, the participant keeps polling
+// QueryDecision before giving up and presuming abort unilaterally.
+const DefaultPresumedAbortTimeout = 30 * time.Second
+
+// queryDecisionPollInterval is how long resolvePrepared waits between
+// successive QueryDecision RPCs while the coordinator is reachable but
+// hasn't decided yet, so it doesn't hammer the coordinator with
+// back-to-back calls as fast as RTT allows.
+const queryDecisionPollInterval = 500 * time.Millisecond
+
+// QueryDecisionArgs is the argument of Coordinator.QueryDecision,
+// used by a participant whose PrepareTimeout fired to proactively
+// ask the coordinator for the transaction's outcome instead of
+// waiting indefinitely.
+type QueryDecisionArgs struct {
+	TxnID     string
+	TxnPartID string
+}
+
+// QueryDecisionReply carries the coordinator's decision, or
+// DecisionUnknown if it has not decided yet.
+type QueryDecisionReply struct {
+	Decision Decision
+}
+
+// ErrLateDecision is returned by Commit when it is invoked for a part
+// that this participant already resolved itself under the
+// presumed-abort rule: the coordinator's decision disagrees with what
+// the participant already did, which is a protocol violation rather
+// than something to silently ignore. An Abort for such a part agrees
+// with it and returns nil.
+var ErrLateDecision = errors.New("twopc: decision arrived for a part already presumed-aborted")
+
+// watchPrepared is started whenever a part enters StateTxnPartPrepared.
+// If the coordinator hasn't resolved it within PrepareTimeout, the
+// participant proactively queries for a decision; if that still
+// hasn't resolved the part within PresumedAbortTimeout, the
+// participant rolls back unilaterally under the classical
+// presumed-abort rule.
+func (ppt *Participant) watchPrepared(tp *TxnPart) {
+	timeout := tp.PrepareTimeout
+	if timeout <= 0 {
+		timeout = ppt.prepareTimeout
+	}
+	time.Sleep(timeout)
+	if atomic.LoadInt32(&tp.state) != StateTxnPartPrepared {
+		return // already resolved by a Commit/Abort RPC
+	}
+	ppt.resolvePrepared(tp)
+}
+
+// resolvePrepared actively queries the coordinator for tp's decision
+// until it gets one, or until PresumedAbortTimeout elapses, in which
+// case it presumes abort.
+func (ppt *Participant) resolvePrepared(tp *TxnPart) {
+	deadline := time.Now().Add(ppt.presumedAbortTimeout)
+	args := QueryDecisionArgs{TxnID: tp.TxnID, TxnPartID: tp.ID}
+	for time.Now().Before(deadline) {
+		if atomic.LoadInt32(&tp.state) != StateTxnPartPrepared {
+			return // resolved while we were polling
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), ppt.callTimeout)
+		var reply QueryDecisionReply
+		err := ppt.coord.Call(ctx, "Coordinator.QueryDecision", args, &reply)
+		cancel()
+
+		if err == nil {
+			switch reply.Decision {
+			case DecisionCommit:
+				ppt.Commit(&CommitArgs{TxnPartID: tp.ID}, &CommitReply{})
+				return
+			case DecisionAbort:
+				ppt.Abort(&AbortArgs{TxnPartID: tp.ID}, &AbortReply{})
+				return
+			}
+			// DecisionUnknown: coordinator hasn't decided yet, keep
+			// polling, but not back-to-back.
+			time.Sleep(queryDecisionPollInterval)
+		}
+	}
+	ppt.presumeAbort(tp)
+}
+
+// presumeAbort unilaterally rolls tp back under the classical
+// presumed-abort rule, after the coordinator stayed unreachable (or
+// undecided) past PresumedAbortTimeout. It races with a genuine
+// Commit/Abort RPC arriving from the coordinator; whichever gets to
+// endTxnPart first wins, and the loser's decision is recorded so it
+// can be reported as a protocol violation rather than ignored.
+//
+// Unlike abort, which logs RecordAborted and lets compaction drop the
+// entry once the part leaves txnsParts, presumeAbort logs
+// RecordPresumedAborted and compactStore keeps that entry around for
+// as long as presumedAborted remembers the part (see compactStore):
+// this is the one case where the participant disagreed with a
+// coordinator that hadn't weighed in yet, and that disagreement must
+// survive a crash so a late decision after restart is still caught
+// instead of silently accepted.
+func (ppt *Participant) presumeAbort(tp *TxnPart) {
+	if ppt.endTxnPart(tp.ID) == nil {
+		return // the coordinator's decision already arrived and ended it
+	}
+	ppt.markPresumedAborted(tp.ID)
+	atomic.StoreInt32(&tp.state, StateTxnPartAborted)
+	if tp.canAbort == false {
+		tp.canAbort = true
+		if tp.rollbacker != nil {
+			tp.rollbacker.Rollback()
+		} else if !tp.ReadOnly {
+			panic("No rollbacker for " + tp.CallName)
+		}
+	}
+	ppt.logRecord(TxnPartRecord{Kind: RecordPresumedAborted, ID: tp.ID, TxnID: tp.TxnID})
+	ppt.compactStore()
+	if ppt.onPresumedAbort != nil {
+		ppt.onPresumedAbort(tp)
+	}
+	log.Printf("Participant(%v) presumed-abort for txn part %v (txn %v): coordinator unreachable or undecided past PresumedAbortTimeout",
+		ppt.addr, tp.ID, tp.TxnID)
+}
+
+func (ppt *Participant) markPresumedAborted(txnPartID string) {
+	ppt.presumedMu.Lock()
+	defer ppt.presumedMu.Unlock()
+	ppt.presumedAborted[txnPartID] = true
+}
+
+func (ppt *Participant) wasPresumedAborted(txnPartID string) bool {
+	ppt.presumedMu.Lock()
+	defer ppt.presumedMu.Unlock()
+	return ppt.presumedAborted[txnPartID]
+}
+
+// SetPrepareTimeout overrides the default PrepareTimeout used for
+// parts that don't set their own TxnPart.PrepareTimeout.
+func (ppt *Participant) SetPrepareTimeout(d time.Duration) {
+	ppt.prepareTimeout = d
+}
+
+// SetPresumedAbortTimeout overrides the default PresumedAbortTimeout.
+func (ppt *Participant) SetPresumedAbortTimeout(d time.Duration) {
+	ppt.presumedAbortTimeout = d
+}
+
+// SetOnPresumedAbort registers a callback invoked whenever the
+// participant unilaterally rolls back a part under the presumed-abort
+// rule, so applications can log or alert on it.
+func (ppt *Participant) SetOnPresumedAbort(callback func(tp *TxnPart)) {
+	ppt.onPresumedAbort = callback
+}
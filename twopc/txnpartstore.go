@@ -0,0 +1,157 @@
+package twopc
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// TxnPartRecordKind identifies the kind of event written to a
+// TxnPartStore for a single TxnPart state transition.
+type TxnPartRecordKind string
+
+const (
+	RecordSubmitted       TxnPartRecordKind = "SUBMITTED"
+	RecordPrepared        TxnPartRecordKind = "PREPARED"
+	RecordAborted         TxnPartRecordKind = "ABORTED"
+	RecordCommitted       TxnPartRecordKind = "COMMITTED"
+	RecordPresumedAborted TxnPartRecordKind = "PRESUMED_ABORTED"
+)
+
+// TxnPartRecord is one entry of a participant's write-ahead log,
+// recording a single state transition of a TxnPart.
+type TxnPartRecord struct {
+	Kind     TxnPartRecordKind
+	ID       string
+	TxnID    string
+	CallName string      `json:",omitempty"`
+	InitRet  interface{} `json:",omitempty"`
+}
+
+// TxnPartStore persists TxnPart state transitions so a Participant
+// can recover in-doubt transactions after a crash. Append must not
+// return until the record is durable, since SubmitTxnPart, prepared,
+// abort and Commit all rely on the record surviving a crash that
+// happens right after they reply to the caller.
+type TxnPartStore interface {
+	// Append durably writes record to the log.
+	Append(record TxnPartRecord) error
+	// Replay returns every record written so far, in write order.
+	Replay() ([]TxnPartRecord, error)
+	// Compact drops log entries for every part whose ID is not in
+	// liveIDs, i.e. parts that have reached a terminal state on both
+	// the participant and the coordinator.
+	Compact(liveIDs map[string]bool) error
+	// Close releases the underlying resources.
+	Close() error
+}
+
+// fileTxnPartStore is the default TxnPartStore: an append-only file,
+// fsync'd after every write.
+type fileTxnPartStore struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// NewFileTxnPartStore opens (creating if necessary) an append-only
+// write-ahead log at path.
+func NewFileTxnPartStore(path string) (TxnPartStore, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("open txn part store %q: %w", path, err)
+	}
+	return &fileTxnPartStore{path: path, f: f}, nil
+}
+
+func (s *fileTxnPartStore) Append(record TxnPartRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := json.NewEncoder(s.f).Encode(record); err != nil {
+		return fmt.Errorf("encode txn part record: %w", err)
+	}
+	return s.f.Sync()
+}
+
+func (s *fileTxnPartStore) Replay() ([]TxnPartRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.replayLocked()
+}
+
+func (s *fileTxnPartStore) replayLocked() ([]TxnPartRecord, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []TxnPartRecord
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var r TxnPartRecord
+		if err := dec.Decode(&r); err != nil {
+			break
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// Compact rewrites the log keeping only the records whose ID is in
+// liveIDs.
+func (s *fileTxnPartStore) Compact(liveIDs map[string]bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.replayLocked()
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("create compacted txn part store: %w", err)
+	}
+	enc := json.NewEncoder(tmp)
+	for _, r := range records {
+		if !liveIDs[r.ID] {
+			continue
+		}
+		if err := enc.Encode(r); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	return nil
+}
+
+func (s *fileTxnPartStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}